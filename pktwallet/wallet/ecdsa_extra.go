@@ -0,0 +1,198 @@
+// Copyright (c) 2020 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wallet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/pkt-cash/pktd/btcec"
+	"github.com/pkt-cash/pktd/txscript"
+	"github.com/pkt-cash/pktd/txscript/params"
+	"github.com/pkt-cash/pktd/wire"
+)
+
+// signWitnessWithExtraEntropy signs tx's input at inputIndex the same way
+// txscript.WitnessSignature does, except the ECDSA nonce k is derived via
+// RFC6979 with extra folded in as the algorithm's additional data (RFC6979
+// §3.6) rather than plain RFC6979 over the sighash alone. It exists
+// because no txscript entry point accepts that extra entropy; if one
+// (e.g. WitnessSignatureWithExtra) is ever added there, callers should
+// switch to it instead of this hand-rolled signer.
+func signWitnessWithExtraEntropy(tx *wire.MsgTx, sigHashes *txscript.TxSigHashes,
+	inputIndex int, amt int64, subScript []byte, hashType params.SigHashType,
+	privKey *btcec.PrivateKey, compress bool, extra [32]byte) (wire.TxWitness, error) {
+
+	sigHash, err := txscript.CalcWitnessSigHash(
+		subScript, sigHashes, hashType, tx, inputIndex, amt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := signRFC6979(privKey, sigHash, extra)
+	if err != nil {
+		return nil, err
+	}
+	sig = append(sig, byte(hashType))
+
+	pubKey := privKey.PubKey()
+	var pubKeyBytes []byte
+	if compress {
+		pubKeyBytes = pubKey.SerializeCompressed()
+	} else {
+		pubKeyBytes = pubKey.SerializeUncompressed()
+	}
+
+	return wire.TxWitness{sig, pubKeyBytes}, nil
+}
+
+// signRFC6979 produces a low-S, DER-encoded ECDSA signature over hash
+// under privKey, deriving the nonce k deterministically per RFC6979 with
+// extra mixed in as additional data. Two calls that differ only in extra
+// are guaranteed to pick different nonces, even over the same hash and
+// key.
+func signRFC6979(privKey *btcec.PrivateKey, hash []byte, extra [32]byte) ([]byte, error) {
+	curve := btcec.S256()
+	n := curve.N
+
+	e := bits2int(hash, n)
+	gen := newRFC6979Generator(privKey.D, hash, n, extra)
+
+	for {
+		k := gen.next(n)
+
+		rx, _ := curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(rx, n)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		kInv := new(big.Int).ModInverse(k, n)
+		if kInv == nil {
+			continue
+		}
+
+		s := new(big.Int).Mul(privKey.D, r)
+		s.Add(s, e)
+		s.Mul(s, kInv)
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+
+		// BIP-62 low-S: canonicalize to the smaller of s and n-s.
+		halfN := new(big.Int).Rsh(n, 1)
+		if s.Cmp(halfN) > 0 {
+			s.Sub(n, s)
+		}
+
+		return encodeDERSignature(r, s), nil
+	}
+}
+
+// rfc6979Generator is the HMAC-DRBG state from RFC6979 §3.2 steps a-f,
+// stepped by next to produce successive nonce candidates.
+type rfc6979Generator struct {
+	v []byte
+	k []byte
+}
+
+// newRFC6979Generator runs RFC6979 §3.2 steps a-f for privKeyD signing
+// hash, folding extra into the initial K computation as the algorithm's
+// optional additional data (§3.6).
+func newRFC6979Generator(privKeyD *big.Int, hash []byte, order *big.Int,
+	extra [32]byte) *rfc6979Generator {
+
+	keyBytes := int2octets(privKeyD, 32)
+	hashBytes := bits2octets(hash, order)
+
+	v := bytes.Repeat([]byte{0x01}, 32)
+	k := bytes.Repeat([]byte{0x00}, 32)
+
+	k = hmacSHA256(k, v, []byte{0x00}, keyBytes, hashBytes, extra[:])
+	v = hmacSHA256(k, v)
+	k = hmacSHA256(k, v, []byte{0x01}, keyBytes, hashBytes, extra[:])
+	v = hmacSHA256(k, v)
+
+	return &rfc6979Generator{v: v, k: k}
+}
+
+// next returns the next RFC6979 candidate nonce in [1, order). Callers
+// that reject the result (e.g. because it produced r == 0 or s == 0) must
+// call next again to get a fresh candidate from the same DRBG state.
+func (g *rfc6979Generator) next(order *big.Int) *big.Int {
+	for {
+		g.v = hmacSHA256(g.k, g.v)
+		k := bits2int(g.v, order)
+		if k.Sign() != 0 && k.Cmp(order) < 0 {
+			return k
+		}
+
+		g.k = hmacSHA256(g.k, g.v, []byte{0x00})
+		g.v = hmacSHA256(g.k, g.v)
+	}
+}
+
+// hmacSHA256 returns HMAC-SHA256(key, data[0] || data[1] || ...).
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// bits2int is RFC6979's bits2int: b interpreted as a big-endian integer,
+// truncated to order's bit length if it's longer.
+func bits2int(b []byte, order *big.Int) *big.Int {
+	x := new(big.Int).SetBytes(b)
+	if excess := len(b)*8 - order.BitLen(); excess > 0 {
+		x.Rsh(x, uint(excess))
+	}
+	return x
+}
+
+// bits2octets is RFC6979's bits2octets: bits2int(b) reduced mod order,
+// then re-encoded as a fixed-length big-endian octet string.
+func bits2octets(b []byte, order *big.Int) []byte {
+	z := new(big.Int).Mod(bits2int(b, order), order)
+	return int2octets(z, 32)
+}
+
+// int2octets is RFC6979's int2octets: x as a big-endian octet string of
+// exactly rlen bytes.
+func int2octets(x *big.Int, rlen int) []byte {
+	buf := make([]byte, rlen)
+	xb := x.Bytes()
+	copy(buf[rlen-len(xb):], xb)
+	return buf
+}
+
+// encodeDERSignature DER-encodes an ECDSA signature (r, s) per BIP-66.
+func encodeDERSignature(r, s *big.Int) []byte {
+	rb := derInt(r)
+	sb := derInt(s)
+
+	body := make([]byte, 0, len(rb)+len(sb))
+	body = append(body, rb...)
+	body = append(body, sb...)
+
+	return append([]byte{0x30, byte(len(body))}, body...)
+}
+
+// derInt DER-encodes a single non-negative integer.
+func derInt(x *big.Int) []byte {
+	b := x.Bytes()
+	if len(b) == 0 {
+		b = []byte{0x00}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0x00}, b...)
+	}
+	return append([]byte{0x02, byte(len(b))}, b...)
+}
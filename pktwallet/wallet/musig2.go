@@ -0,0 +1,493 @@
+// Copyright (c) 2021 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wallet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sort"
+
+	"github.com/pkt-cash/pktd/btcec"
+	"github.com/pkt-cash/pktd/chaincfg/chainhash"
+)
+
+// BIP-327/BIP-340 tagged-hash domains used throughout key and nonce
+// aggregation below.
+var (
+	musig2TagKeyAggList  = []byte("KeyAgg list")
+	musig2TagKeyAggCoeff = []byte("KeyAgg coefficient")
+	musig2TagNonceCoeff  = []byte("MuSig/noncecoef")
+	musig2TagChallenge   = []byte("BIP0340/challenge")
+)
+
+// MuSig2SessionID is an opaque handle identifying an in-progress MuSig2
+// signing session. It never leaves the process and carries no key
+// material itself; callers pass it back into the other MuSig2* methods.
+//
+// NOT DELIVERED: the request asked for a PrivKeyTweaker-compatible bridge
+// so ComputeInputScript could drive a MuSig2 session directly. That bridge
+// is deliberately absent — ComputeInputScript's tweaker contract finishes
+// with one signer's solo BIP-340 signature over its own key, which is not
+// a MuSig2 partial signature, so wiring the two together would produce an
+// aggregate-key output that a solo signature can never satisfy. Flagging
+// this back to the requester rather than shipping a bridge that can't
+// work: a MuSig2 spend needs to be driven end-to-end through this session
+// API (MuSig2CreateSession, MuSig2RegisterNonces, MuSig2Sign,
+// MuSig2CombineSig), with the resulting 64-byte aggregate signature
+// attached to the input's witness directly by the caller. If
+// ComputeInputScript integration is still wanted, it needs a new return
+// path (e.g. "partial signature pending" rather than a finished witness),
+// which is a larger, separate change to this method's contract.
+type MuSig2SessionID [32]byte
+
+// muSig2Session tracks everything a single MuSig2 signing session needs to
+// go from nonce exchange to a combined BIP-340 Schnorr signature. It is
+// wiped in place by MuSig2Cleanup rather than simply unlinked, since it
+// holds secret nonces and our own copy of the private key share.
+type muSig2Session struct {
+	// localPriv is our own copy of the local signer's secret scalar,
+	// taken at session-creation time so that MuSig2Cleanup can wipe it
+	// without reaching into (and corrupting) the caller-owned
+	// *btcec.PrivateKey that was passed into MuSig2CreateSession.
+	localPriv *big.Int
+	localIdx  int
+
+	pubKeys []*btcec.PublicKey
+	coeffs  []*big.Int
+
+	combinedKey *btcec.PublicKey
+
+	// keyParity is the BIP-327 KeyAgg "gacc" value: 1, or n-1 if a tweak
+	// was applied and the untweaked aggregate key had an odd Y, so every
+	// signer's coefficient must be negated to compensate. tweak is the
+	// accumulated additive tweak ("tacc") applied on top, e.g. the
+	// BIP-86 output-key tweak; it's zero when no tweak was requested.
+	keyParity *big.Int
+	tweak     *big.Int
+
+	localNonce1 *big.Int
+	localNonce2 *big.Int
+	nonces      map[int][2]*btcec.PublicKey
+
+	msg [32]byte
+}
+
+// musig2Session looks up an in-progress session by ID, failing if it's
+// unknown (already cleaned up, or never created).
+func (w *Wallet) musig2Session(id MuSig2SessionID) (*muSig2Session, error) {
+	w.musig2Mtx.Lock()
+	defer w.musig2Mtx.Unlock()
+
+	sess, ok := w.musig2Sessions[id]
+	if !ok {
+		return nil, errors.New("musig2: unknown session ID")
+	}
+
+	return sess, nil
+}
+
+// MuSig2CreateSession initializes a new MuSig2 signing session for the
+// given set of participant public keys via musig2KeyAgg, aggregating
+// them into a single combined key and generating this wallet's share of
+// the nonce (R1, R2). If tweak is non-empty it's applied to the combined
+// key afterwards, e.g. the BIP-86 output-key tweak for a taproot key-path
+// spend. localKey is the private key this wallet contributes; it must
+// correspond to one of the entries in pubKeys.
+func (w *Wallet) MuSig2CreateSession(localKey *btcec.PrivateKey,
+	pubKeys []*btcec.PublicKey, tweak []byte) (MuSig2SessionID,
+	*btcec.PublicKey, error) {
+
+	localIdx, coeffs, aggKey, err := musig2KeyAgg(
+		pubKeys, localKey.PubKey(),
+	)
+	if err != nil {
+		return MuSig2SessionID{}, nil, err
+	}
+
+	combinedKey, keyParity, tweakAcc, err := musig2ApplyTweak(aggKey, tweak)
+	if err != nil {
+		return MuSig2SessionID{}, nil, err
+	}
+
+	k1, err := musig2RandScalar()
+	if err != nil {
+		return MuSig2SessionID{}, nil, err
+	}
+	k2, err := musig2RandScalar()
+	if err != nil {
+		return MuSig2SessionID{}, nil, err
+	}
+
+	sess := &muSig2Session{
+		localPriv:   new(big.Int).Set(localKey.D),
+		localIdx:    localIdx,
+		pubKeys:     pubKeys,
+		coeffs:      coeffs,
+		combinedKey: combinedKey,
+		keyParity:   keyParity,
+		tweak:       tweakAcc,
+		localNonce1: k1,
+		localNonce2: k2,
+		nonces:      make(map[int][2]*btcec.PublicKey),
+	}
+	sess.nonces[localIdx] = [2]*btcec.PublicKey{
+		musig2ScalarBasePoint(k1),
+		musig2ScalarBasePoint(k2),
+	}
+
+	var id MuSig2SessionID
+	if _, err := rand.Read(id[:]); err != nil {
+		return MuSig2SessionID{}, nil, err
+	}
+
+	w.musig2Mtx.Lock()
+	if w.musig2Sessions == nil {
+		w.musig2Sessions = make(map[MuSig2SessionID]*muSig2Session)
+	}
+	w.musig2Sessions[id] = sess
+	w.musig2Mtx.Unlock()
+
+	return id, combinedKey, nil
+}
+
+// MuSig2RegisterNonces records the nonce pair (R1, R2) a remote
+// co-signer contributed for participant index idx of session id. idx
+// refers to that signer's position in the pubKeys slice originally
+// passed to MuSig2CreateSession.
+func (w *Wallet) MuSig2RegisterNonces(id MuSig2SessionID, idx int,
+	r1, r2 *btcec.PublicKey) error {
+
+	sess, err := w.musig2Session(id)
+	if err != nil {
+		return err
+	}
+	if idx < 0 || idx >= len(sess.pubKeys) {
+		return errors.New("musig2: nonce index out of range")
+	}
+
+	w.musig2Mtx.Lock()
+	defer w.musig2Mtx.Unlock()
+	sess.nonces[idx] = [2]*btcec.PublicKey{r1, r2}
+
+	return nil
+}
+
+// MuSig2Sign produces this wallet's partial signature over msg for
+// session id. Every participant's nonces must have been registered first
+// (via MuSig2CreateSession for the local share, MuSig2RegisterNonces for
+// everyone else).
+func (w *Wallet) MuSig2Sign(id MuSig2SessionID, msg [32]byte) (*big.Int, error) {
+	sess, err := w.musig2Session(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sess.nonces) != len(sess.pubKeys) {
+		return nil, errors.New(
+			"musig2: not all participants have registered nonces",
+		)
+	}
+	sess.msg = msg
+
+	aggR1, aggR2 := musig2AggregateNonces(sess.pubKeys, sess.nonces)
+	b := musig2NonceCoeff(aggR1, aggR2, sess.combinedKey, msg)
+	r := musig2CombineNonce(aggR1, aggR2, b)
+	e := musig2Challenge(r, sess.combinedKey, msg)
+
+	n := btcec.S256().N
+
+	// A BIP-340 verifier reconstructs R = s*G - e*X and requires R to
+	// have an even Y, and likewise takes X itself to be the even-Y
+	// point with that X coordinate. Neither the combined key nor the
+	// combined nonce point is guaranteed to land on an even Y, so we
+	// negate the scalars that produced them (our share of the key, our
+	// nonces) whenever they don't, compensating for the sign flip that
+	// would otherwise make the final signature fail to verify.
+	keyCoeff := new(big.Int).Mul(sess.coeffs[sess.localIdx], sess.keyParity)
+	keyCoeff.Mul(keyCoeff, musig2ParityScalar(sess.combinedKey))
+	keyCoeff.Mod(keyCoeff, n)
+
+	k1, k2 := sess.localNonce1, sess.localNonce2
+	if musig2IsOddY(r) {
+		k1 = new(big.Int).Sub(n, k1)
+		k2 = new(big.Int).Sub(n, k2)
+	}
+
+	s := new(big.Int).Mul(b, k2)
+	s.Add(s, k1)
+
+	ea := new(big.Int).Mul(e, keyCoeff)
+	ea.Mul(ea, sess.localPriv)
+	s.Add(s, ea)
+	s.Mod(s, n)
+
+	return s, nil
+}
+
+// MuSig2CombineSig combines this wallet's and every other participant's
+// partial signatures for session id into a single 64-byte BIP-340 Schnorr
+// signature.
+func (w *Wallet) MuSig2CombineSig(id MuSig2SessionID,
+	partialSigs []*big.Int) ([]byte, error) {
+
+	sess, err := w.musig2Session(id)
+	if err != nil {
+		return nil, err
+	}
+
+	n := btcec.S256().N
+	s := new(big.Int)
+	for _, partial := range partialSigs {
+		s.Add(s, partial)
+	}
+
+	aggR1, aggR2 := musig2AggregateNonces(sess.pubKeys, sess.nonces)
+	b := musig2NonceCoeff(aggR1, aggR2, sess.combinedKey, sess.msg)
+	r := musig2CombineNonce(aggR1, aggR2, b)
+	e := musig2Challenge(r, sess.combinedKey, sess.msg)
+
+	// The tweak applied in MuSig2CreateSession (if any) was deliberately
+	// left out of every individual partial signature; fold its e*g*tacc
+	// contribution in exactly once here instead, per BIP-327's
+	// partial_sig_agg, using the final combined key's parity.
+	if sess.tweak.Sign() != 0 {
+		tweakTerm := new(big.Int).Mul(e, musig2ParityScalar(sess.combinedKey))
+		tweakTerm.Mul(tweakTerm, sess.tweak)
+		s.Add(s, tweakTerm)
+	}
+	s.Mod(s, n)
+
+	sig := make([]byte, 64)
+	rBytes := r.X.Bytes()
+	copy(sig[32-len(rBytes):32], rBytes)
+	sBytes := s.Bytes()
+	copy(sig[64-len(sBytes):64], sBytes)
+
+	return sig, nil
+}
+
+// MuSig2Cleanup wipes and discards all state for session id. It is safe
+// to call on an already-cleaned-up or unknown session.
+func (w *Wallet) MuSig2Cleanup(id MuSig2SessionID) {
+	w.musig2Mtx.Lock()
+	defer w.musig2Mtx.Unlock()
+
+	sess, ok := w.musig2Sessions[id]
+	if !ok {
+		return
+	}
+
+	if sess.localNonce1 != nil {
+		sess.localNonce1.SetInt64(0)
+	}
+	if sess.localNonce2 != nil {
+		sess.localNonce2.SetInt64(0)
+	}
+	if sess.localPriv != nil {
+		sess.localPriv.SetInt64(0)
+	}
+
+	delete(w.musig2Sessions, id)
+}
+
+// musig2RandScalar draws a uniformly random scalar in [1, n).
+func musig2RandScalar() (*big.Int, error) {
+	n := btcec.S256().N
+	for {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+
+		k := new(big.Int).SetBytes(buf)
+		if k.Sign() != 0 && k.Cmp(n) < 0 {
+			return k, nil
+		}
+	}
+}
+
+// musig2ScalarBasePoint returns k*G as a public key.
+func musig2ScalarBasePoint(k *big.Int) *btcec.PublicKey {
+	x, y := btcec.S256().ScalarBaseMult(k.Bytes())
+	return &btcec.PublicKey{Curve: btcec.S256(), X: x, Y: y}
+}
+
+// musig2KeyAgg aggregates keys in the manner of BIP-327's KeyAgg: it sorts
+// the participant public keys, derives L = H(sorted pubkeys), computes each
+// signer's coefficient a_i = H_agg(L, X_i), and returns the coefficient
+// list (in the original, unsorted pubKeys order), the aggregated key X =
+// sum(a_i * X_i), and the index of localPub within pubKeys. Every key,
+// including the second distinct one that BIP-327 gives a coefficient of 1,
+// gets a hashed coefficient, so X differs from the key a standard BIP-327
+// implementation aggregates from the same pubkeys.
+func musig2KeyAgg(pubKeys []*btcec.PublicKey, localPub *btcec.PublicKey) (
+	int, []*big.Int, *btcec.PublicKey, error) {
+
+	if len(pubKeys) == 0 {
+		return 0, nil, nil, errors.New("musig2: no participant public keys")
+	}
+
+	localIdx := -1
+	serialized := make([][]byte, len(pubKeys))
+	for i, pk := range pubKeys {
+		serialized[i] = pk.SerializeCompressed()
+		if bytes.Equal(serialized[i], localPub.SerializeCompressed()) {
+			localIdx = i
+		}
+	}
+	if localIdx == -1 {
+		return 0, nil, nil, errors.New(
+			"musig2: local public key not found among participants",
+		)
+	}
+
+	sorted := make([][]byte, len(serialized))
+	copy(sorted, serialized)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	l := chainhash.TaggedHash(musig2TagKeyAggList, bytes.Join(sorted, nil))
+
+	n := btcec.S256().N
+	coeffs := make([]*big.Int, len(pubKeys))
+	var x, y *big.Int
+	for i, pk := range pubKeys {
+		h := chainhash.TaggedHash(
+			musig2TagKeyAggCoeff, l[:], serialized[i],
+		)
+		a := new(big.Int).Mod(new(big.Int).SetBytes(h[:]), n)
+		coeffs[i] = a
+
+		px, py := btcec.S256().ScalarMult(pk.X, pk.Y, a.Bytes())
+		if x == nil {
+			x, y = px, py
+		} else {
+			x, y = btcec.S256().Add(x, y, px, py)
+		}
+	}
+
+	return localIdx, coeffs, &btcec.PublicKey{Curve: btcec.S256(), X: x, Y: y}, nil
+}
+
+// musig2IsOddY reports whether p's Y coordinate is odd.
+func musig2IsOddY(p *btcec.PublicKey) bool {
+	return p.Y.Bit(0) == 1
+}
+
+// musig2ParityScalar returns 1 if p has an even Y, or n-1 (i.e. -1 mod n)
+// if it's odd. Multiplying a signer's secret-key coefficient by this
+// value compensates for BIP-340 always taking the even-Y point with a
+// given X coordinate as "the" public key.
+func musig2ParityScalar(p *btcec.PublicKey) *big.Int {
+	if !musig2IsOddY(p) {
+		return big.NewInt(1)
+	}
+	return new(big.Int).Sub(btcec.S256().N, big.NewInt(1))
+}
+
+// musig2NegatePoint returns -p, i.e. (p.X, p.Y negated in the field).
+func musig2NegatePoint(p *btcec.PublicKey) *btcec.PublicKey {
+	negY := new(big.Int).Sub(btcec.S256().P, p.Y)
+	negY.Mod(negY, btcec.S256().P)
+	return &btcec.PublicKey{Curve: btcec.S256(), X: p.X, Y: negY}
+}
+
+// musig2ApplyTweak applies BIP-327's "apply tweak" step to the untweaked
+// KeyAgg output aggKey: if aggKey has an odd Y, it (and every signer's
+// share of it) is implicitly negated before the tweak is added, since
+// BIP-340 only ever works with even-Y points. It returns the resulting
+// combined key, the parity multiplier (keyParity, "gacc") that must be
+// folded into every signer's secret-key coefficient to account for that
+// negation, and the accumulated tweak value (tweakAcc, "tacc") that
+// MuSig2CombineSig must add to the summed partial signatures. A nil or
+// empty tweak is a no-op: keyParity is 1 and tweakAcc is 0.
+func musig2ApplyTweak(aggKey *btcec.PublicKey, tweak []byte) (
+	*btcec.PublicKey, *big.Int, *big.Int, error) {
+
+	if len(tweak) == 0 {
+		return aggKey, big.NewInt(1), big.NewInt(0), nil
+	}
+	if len(tweak) != 32 {
+		return nil, nil, nil, errors.New("musig2: tweak must be 32 bytes")
+	}
+
+	keyParity := musig2ParityScalar(aggKey)
+	base := aggKey
+	if musig2IsOddY(aggKey) {
+		base = musig2NegatePoint(aggKey)
+	}
+
+	n := btcec.S256().N
+	tweakAcc := new(big.Int).Mod(new(big.Int).SetBytes(tweak), n)
+
+	tx, ty := btcec.S256().ScalarBaseMult(tweakAcc.Bytes())
+	x, y := btcec.S256().Add(base.X, base.Y, tx, ty)
+
+	return &btcec.PublicKey{Curve: btcec.S256(), X: x, Y: y}, keyParity, tweakAcc, nil
+}
+
+// musig2AggregateNonces sums every registered participant's R1 and R2
+// points independently, producing the session's aggregate nonce pair.
+func musig2AggregateNonces(pubKeys []*btcec.PublicKey,
+	nonces map[int][2]*btcec.PublicKey) (*btcec.PublicKey, *btcec.PublicKey) {
+
+	var r1x, r1y, r2x, r2y *big.Int
+	for i := range pubKeys {
+		pair := nonces[i]
+
+		if r1x == nil {
+			r1x, r1y = pair[0].X, pair[0].Y
+			r2x, r2y = pair[1].X, pair[1].Y
+			continue
+		}
+		r1x, r1y = btcec.S256().Add(r1x, r1y, pair[0].X, pair[0].Y)
+		r2x, r2y = btcec.S256().Add(r2x, r2y, pair[1].X, pair[1].Y)
+	}
+
+	return &btcec.PublicKey{Curve: btcec.S256(), X: r1x, Y: r1y},
+		&btcec.PublicKey{Curve: btcec.S256(), X: r2x, Y: r2y}
+}
+
+// musig2NonceCoeff computes b = H_non(aggR1 || aggR2, X, m), the blinding
+// coefficient used to combine the two aggregate nonce points. Per BIP-327,
+// X is hashed in as its 32-byte x-only encoding, not the 33-byte
+// SEC1-compressed point.
+func musig2NonceCoeff(aggR1, aggR2, combinedKey *btcec.PublicKey,
+	msg [32]byte) *big.Int {
+
+	h := chainhash.TaggedHash(
+		musig2TagNonceCoeff,
+		aggR1.SerializeCompressed(), aggR2.SerializeCompressed(),
+		musig2XOnlyBytes(combinedKey), msg[:],
+	)
+	return new(big.Int).Mod(new(big.Int).SetBytes(h[:]), btcec.S256().N)
+}
+
+// musig2XOnlyBytes returns p's X coordinate as a 32-byte big-endian
+// BIP-340 x-only encoding.
+func musig2XOnlyBytes(p *btcec.PublicKey) []byte {
+	var xBuf [32]byte
+	xBytes := p.X.Bytes()
+	copy(xBuf[32-len(xBytes):], xBytes)
+	return xBuf[:]
+}
+
+// musig2CombineNonce returns R = aggR1 + b*aggR2.
+func musig2CombineNonce(aggR1, aggR2 *btcec.PublicKey, b *big.Int) *btcec.PublicKey {
+	bx, by := btcec.S256().ScalarMult(aggR2.X, aggR2.Y, b.Bytes())
+	x, y := btcec.S256().Add(aggR1.X, aggR1.Y, bx, by)
+	return &btcec.PublicKey{Curve: btcec.S256(), X: x, Y: y}
+}
+
+// musig2Challenge computes the BIP-340 Schnorr challenge e = H_sig(R.x,
+// X.x, m) for the combined nonce point R and combined key X.
+func musig2Challenge(r, combinedKey *btcec.PublicKey, msg [32]byte) *big.Int {
+	h := chainhash.TaggedHash(
+		musig2TagChallenge, musig2XOnlyBytes(r), musig2XOnlyBytes(combinedKey),
+		msg[:],
+	)
+	return new(big.Int).Mod(new(big.Int).SetBytes(h[:]), btcec.S256().N)
+}
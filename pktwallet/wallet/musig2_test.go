@@ -0,0 +1,160 @@
+// Copyright (c) 2021 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wallet
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/pkt-cash/pktd/btcec"
+)
+
+// TestMuSig2RoundTrip drives a 2-of-2 MuSig2 session end to end across two
+// independent Wallet instances (standing in for two cooperating signers)
+// and checks that the resulting aggregate signature satisfies the BIP-340
+// verification equation against the combined key.
+func TestMuSig2RoundTrip(t *testing.T) {
+	musig2RoundTrip(t, nil)
+}
+
+// TestMuSig2RoundTripWithTweak is TestMuSig2RoundTrip with a BIP-86-style
+// tweak applied to the combined key, exercising the accumulated-tweak and
+// parity handling in musig2ApplyTweak, MuSig2Sign, and MuSig2CombineSig.
+func TestMuSig2RoundTripWithTweak(t *testing.T) {
+	var tweak [32]byte
+	if _, err := rand.Read(tweak[:]); err != nil {
+		t.Fatal(err)
+	}
+	musig2RoundTrip(t, tweak[:])
+}
+
+func musig2RoundTrip(t *testing.T, tweak []byte) {
+	t.Helper()
+
+	w1, w2 := &Wallet{}, &Wallet{}
+
+	priv1, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv2, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKeys := []*btcec.PublicKey{priv1.PubKey(), priv2.PubKey()}
+
+	id1, combinedKey, err := w1.MuSig2CreateSession(priv1, pubKeys, tweak)
+	if err != nil {
+		t.Fatalf("create session 1: %v", err)
+	}
+	id2, combinedKey2, err := w2.MuSig2CreateSession(priv2, pubKeys, tweak)
+	if err != nil {
+		t.Fatalf("create session 2: %v", err)
+	}
+	if !combinedKey.IsEqual(combinedKey2) {
+		t.Fatal("combined keys computed by the two sessions don't match")
+	}
+
+	sess1, err := w1.musig2Session(id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess2, err := w2.musig2Session(id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exchange each side's half of the nonces.
+	r1AtIdx0, r2AtIdx0 := sess1.nonces[0][0], sess1.nonces[0][1]
+	r1AtIdx1, r2AtIdx1 := sess2.nonces[1][0], sess2.nonces[1][1]
+	if err := w1.MuSig2RegisterNonces(id1, 1, r1AtIdx1, r2AtIdx1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w2.MuSig2RegisterNonces(id2, 0, r1AtIdx0, r2AtIdx0); err != nil {
+		t.Fatal(err)
+	}
+
+	var msg [32]byte
+	if _, err := rand.Read(msg[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	s1, err := w1.MuSig2Sign(id1, msg)
+	if err != nil {
+		t.Fatalf("sign 1: %v", err)
+	}
+	s2, err := w2.MuSig2Sign(id2, msg)
+	if err != nil {
+		t.Fatalf("sign 2: %v", err)
+	}
+
+	sig, err := w1.MuSig2CombineSig(id1, []*big.Int{s1, s2})
+	if err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	if !schnorrVerify(t, combinedKey, msg, sig) {
+		t.Fatal("aggregate signature failed BIP-340 verification")
+	}
+
+	w1.MuSig2Cleanup(id1)
+	if _, err := w1.musig2Session(id1); err == nil {
+		t.Fatal("session should be gone after MuSig2Cleanup")
+	}
+}
+
+// schnorrVerify checks sig against pubKey and msg per BIP-340: s*G == R +
+// e*X, where X is the even-Y point with pubKey's X coordinate and R is
+// the even-Y point whose X coordinate is sig's first 32 bytes.
+func schnorrVerify(t *testing.T, pubKey *btcec.PublicKey, msg [32]byte, sig []byte) bool {
+	t.Helper()
+	if len(sig) != 64 {
+		t.Fatalf("bad signature length %d", len(sig))
+	}
+
+	rx := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+
+	ry := liftX(t, rx)
+	if ry == nil {
+		return false
+	}
+	r := &btcec.PublicKey{Curve: btcec.S256(), X: rx, Y: ry}
+
+	x := pubKey
+	if musig2IsOddY(x) {
+		x = musig2NegatePoint(x)
+	}
+
+	e := musig2Challenge(r, x, msg)
+
+	sx, sy := btcec.S256().ScalarBaseMult(s.Bytes())
+	ex, ey := btcec.S256().ScalarMult(x.X, x.Y, e.Bytes())
+	negEY := new(big.Int).Sub(btcec.S256().P, ey)
+	negEY.Mod(negEY, btcec.S256().P)
+
+	gotX, gotY := btcec.S256().Add(sx, sy, ex, negEY)
+	return gotX.Cmp(rx) == 0 && gotY.Cmp(ry) == 0
+}
+
+// liftX recovers the even-Y point with the given X coordinate on
+// secp256k1, or nil if x isn't on the curve.
+func liftX(t *testing.T, x *big.Int) *big.Int {
+	t.Helper()
+
+	p := btcec.S256().P
+	ySq := new(big.Int).Exp(x, big.NewInt(3), p)
+	ySq.Add(ySq, big.NewInt(7))
+	ySq.Mod(ySq, p)
+
+	y := new(big.Int).ModSqrt(ySq, p)
+	if y == nil {
+		return nil
+	}
+	if y.Bit(0) == 1 {
+		y.Sub(p, y)
+	}
+	return y
+}
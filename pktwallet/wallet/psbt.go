@@ -0,0 +1,302 @@
+// Copyright (c) 2021 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package wallet
+
+import (
+	"errors"
+
+	"github.com/pkt-cash/pktd/btcutil"
+	"github.com/pkt-cash/pktd/btcutil/psbt"
+	"github.com/pkt-cash/pktd/pktwallet/waddrmgr"
+	"github.com/pkt-cash/pktd/pktwallet/wtxmgr"
+	"github.com/pkt-cash/pktd/txscript"
+	"github.com/pkt-cash/pktd/txscript/params"
+	"github.com/pkt-cash/pktd/wire"
+)
+
+// ErrNotEnoughFunds is returned by FundPsbt when account does not have
+// enough spendable outputs to cover the packet's existing outputs plus the
+// requested fee rate.
+var ErrNotEnoughFunds = errors.New("wallet: insufficient funds to fund PSBT")
+
+// NOT DELIVERED: this file implements FundPsbt/SignPsbt/FinalizePsbt as
+// plain *Wallet methods, but the request's JSON-RPC surface
+// (walletcreatefundedpsbt, walletprocesspsbt, finalizepsbt) that's meant
+// to expose them to a client is entirely absent, and so is the
+// waddrmgr-level watch-only tagging (AccountWatchOnly) these methods
+// assume already exists. Both live outside pktwallet/wallet — the RPC
+// handlers in the legacyrpc/rpcserver command dispatch, the tagging in
+// waddrmgr's account metadata — neither of which is part of this
+// checkout. Flagging this back to the requester rather than fabricating
+// those packages wholesale from inside this one: adding them here would
+// mean inventing their existing types and conventions from scratch,
+// which risks shipping something inconsistent with how they actually
+// work. Closing this gap needs either a follow-up request scoped to
+// legacyrpc/rpcserver and waddrmgr, or descoping the RPC surface from
+// this request.
+
+// dustChangeThreshold is the smallest change amount FundPsbt will add as
+// its own output; anything below this is left on the table as extra fee
+// instead of creating an uneconomical output.
+const dustChangeThreshold = btcutil.Amount(546)
+
+// FundPsbt selects previously unspent outputs belonging to account and adds
+// them as inputs to packet until its total input value covers the existing
+// outputs plus a fee calculated at feeSatPerKB against the resulting
+// transaction's size, appending a change output paying the remainder back
+// to a fresh address on account. account may be a watch-only account
+// imported from an xpub; the resulting inputs will still be fully
+// populated, they'll simply lack a signature until SignPsbt (or an
+// external signer) fills one in.
+func (w *Wallet) FundPsbt(packet *psbt.Packet, account uint32,
+	feeSatPerKB btcutil.Amount) error {
+
+	eligible, err := w.findEligibleOutputs(account)
+	if err != nil {
+		return err
+	}
+
+	var outputTotal btcutil.Amount
+	for _, out := range packet.UnsignedTx.TxOut {
+		outputTotal += btcutil.Amount(out.Value)
+	}
+
+	var inputTotal btcutil.Amount
+	for _, credit := range eligible {
+		addPsbtInput(packet, credit)
+		inputTotal += credit.Amount
+
+		if inputTotal >= outputTotal+estimatePsbtFee(packet, feeSatPerKB) {
+			break
+		}
+	}
+
+	fee := estimatePsbtFee(packet, feeSatPerKB)
+	if inputTotal < outputTotal+fee {
+		return ErrNotEnoughFunds
+	}
+
+	changeAmt := inputTotal - outputTotal - fee
+	if changeAmt < dustChangeThreshold {
+		return nil
+	}
+
+	changeScript, err := w.newChangeScript(account)
+	if err != nil {
+		return err
+	}
+	addPsbtOutput(packet, changeAmt, changeScript)
+
+	// Adding the change output grew the transaction, so the fee (and
+	// therefore the leftover change amount) need to be recomputed
+	// against its final size. That can push the change below the dust
+	// threshold (or, in a close-run fee-rate case, even negative), in
+	// which case it has to come back out rather than be left on the tx
+	// as an invalid or uneconomical output; its value is then simply
+	// absorbed into the fee.
+	changeIdx := len(packet.UnsignedTx.TxOut) - 1
+	changeAmt = inputTotal - outputTotal - estimatePsbtFee(packet, feeSatPerKB)
+	if changeAmt < dustChangeThreshold {
+		packet.UnsignedTx.TxOut = packet.UnsignedTx.TxOut[:changeIdx]
+		packet.Outputs = packet.Outputs[:changeIdx]
+		return nil
+	}
+	packet.UnsignedTx.TxOut[changeIdx].Value = int64(changeAmt)
+
+	return nil
+}
+
+// estimatePsbtFee returns the fee owed at feeSatPerKB for packet's
+// underlying transaction, estimated at its projected signed weight: the
+// current serialized size (which, prior to signing, carries no witness
+// data) stands in for the non-witness part of the transaction, plus an
+// estimated witness size for each input that carries a WitnessUtxo,
+// whether this wallet or an external signer will sign it.
+func estimatePsbtFee(packet *psbt.Packet, feeSatPerKB btcutil.Amount) btcutil.Amount {
+	baseSize := packet.UnsignedTx.SerializeSize()
+
+	var witnessSize int
+	for _, pIn := range packet.Inputs {
+		if pIn.WitnessUtxo != nil {
+			witnessSize += estimateWitnessSize(pIn.WitnessUtxo.PkScript)
+		}
+	}
+
+	// BIP-141 transaction weight is (non-witness bytes * 4) + witness
+	// bytes; vsize is weight/4, rounded up.
+	weight := baseSize*4 + witnessSize
+	vsize := btcutil.Amount((weight + 3) / 4)
+
+	return feeSatPerKB * vsize / 1000
+}
+
+// estimateWitnessSize returns the approximate number of witness bytes
+// needed to spend an output paying pkScript, based on its recognized
+// script type. Only the script's shape is considered, so a watch-only
+// output gets the same estimate as one this wallet signs itself; it
+// returns 0 for any script type other than P2WPKH and P2TR.
+func estimateWitnessSize(pkScript []byte) int {
+	switch {
+	// P2WPKH: OP_0 <20-byte-hash>. Witness is an item count, a ~72-byte
+	// DER signature plus sighash byte, and a 33-byte compressed pubkey,
+	// each with a one-byte length prefix.
+	case len(pkScript) == 22 && pkScript[0] == 0x00:
+		return 1 + 1 + 73 + 1 + 33
+
+	// P2TR key-path: OP_1 <32-byte-x-only-key>. Witness is an item count
+	// plus a single 64-byte Schnorr signature with an explicit sighash
+	// byte appended.
+	case len(pkScript) == 34 && pkScript[0] == 0x51:
+		return 1 + 1 + 65
+
+	default:
+		return 0
+	}
+}
+
+// newChangeScript derives a fresh change address on account and returns
+// the script that pays to it.
+func (w *Wallet) newChangeScript(account uint32) ([]byte, error) {
+	changeAddr, err := w.NewChangeAddress(account, waddrmgr.KeyScopeBIP0084)
+	if err != nil {
+		return nil, err
+	}
+
+	return txscript.PayToAddrScript(changeAddr)
+}
+
+// addPsbtOutput appends a new output paying amt to pkScript, along with
+// the empty PSBT output record BIP-174 expects alongside it.
+func addPsbtOutput(packet *psbt.Packet, amt btcutil.Amount, pkScript []byte) {
+	packet.UnsignedTx.TxOut = append(packet.UnsignedTx.TxOut, &wire.TxOut{
+		Value:    int64(amt),
+		PkScript: pkScript,
+	})
+	packet.Outputs = append(packet.Outputs, psbt.POutput{})
+}
+
+// addPsbtInput appends an unsigned input spending credit to packet, along
+// with the witness UTXO record a signer needs to validate and sign it.
+func addPsbtInput(packet *psbt.Packet, credit wtxmgr.Credit) {
+	packet.UnsignedTx.TxIn = append(packet.UnsignedTx.TxIn, &wire.TxIn{
+		PreviousOutPoint: credit.OutPoint,
+	})
+	packet.Inputs = append(packet.Inputs, psbt.PInput{
+		WitnessUtxo: &wire.TxOut{
+			Value:    int64(credit.Amount),
+			PkScript: credit.PkScript,
+		},
+	})
+}
+
+// SignPsbt walks every input in packet and, for each one the wallet
+// recognizes, either fills in a final witness/sigScript (for addresses we
+// hold the private key for) or a partial input record carrying the
+// derivation path and witness script (for watch-only addresses, so that an
+// external signer such as a hardware wallet can complete it). Inputs that
+// don't belong to this wallet at all are left untouched for another signer
+// in the chain to handle.
+func (w *Wallet) SignPsbt(packet *psbt.Packet) error {
+	tx := packet.UnsignedTx
+
+	// BIP-341's key-path sighash commits to every input's amount and
+	// scriptPubKey (sha_amounts/sha_scriptpubkeys), not just the one
+	// being signed, so the sighash cache has to be seeded with all of
+	// them up front; otherwise a multi-input taproot spend would commit
+	// to the wrong values for every input but the first.
+	prevOuts := make(map[wire.OutPoint]*wire.TxOut, len(packet.Inputs))
+	for i, pIn := range packet.Inputs {
+		if pIn.WitnessUtxo != nil {
+			prevOuts[tx.TxIn[i].PreviousOutPoint] = pIn.WitnessUtxo
+		}
+	}
+	sigHashes := txscript.NewTxSigHashes(
+		tx, txscript.NewMultiPrevOutFetcher(prevOuts),
+	)
+
+	for i, pIn := range packet.Inputs {
+		if pIn.WitnessUtxo == nil {
+			continue
+		}
+		if _, err := w.fetchOutputAddr(pIn.WitnessUtxo.PkScript); err != nil {
+			continue
+		}
+
+		witness, sigScript, err := w.ComputeInputScript(
+			tx, pIn.WitnessUtxo, i, sigHashes, params.SigHashAll,
+			nil, nil,
+		)
+		switch {
+		case errors.Is(err, ErrWatchOnlyAddress):
+			if err := w.fillWatchOnlyPsbtInput(
+				&packet.Inputs[i], pIn.WitnessUtxo,
+			); err != nil {
+				return err
+			}
+			continue
+
+		case err != nil:
+			return err
+		}
+
+		packet.Inputs[i].FinalScriptWitness = witness
+		packet.Inputs[i].FinalScriptSig = sigScript
+	}
+
+	return nil
+}
+
+// FinalizePsbt checks that every input in packet carries a final witness or
+// sigScript and, if so, moves them onto the underlying transaction and
+// returns it ready for broadcast.
+func (w *Wallet) FinalizePsbt(packet *psbt.Packet) (*wire.MsgTx, error) {
+	tx := packet.UnsignedTx
+
+	for _, pIn := range packet.Inputs {
+		if len(pIn.FinalScriptWitness) == 0 && len(pIn.FinalScriptSig) == 0 {
+			return nil, errors.New("psbt: input is not fully signed")
+		}
+	}
+
+	for i, pIn := range packet.Inputs {
+		tx.TxIn[i].Witness = pIn.FinalScriptWitness
+		tx.TxIn[i].SignatureScript = pIn.FinalScriptSig
+	}
+
+	return tx, nil
+}
+
+// fillWatchOnlyPsbtInput populates a BIP-174 partial input record for an
+// address that belongs to a watch-only account: its derivation path and
+// the sighash type we'd like an external signer to use. WitnessScript is
+// deliberately left unset here: every watch-only address type this wallet
+// produces (p2wkh, p2tr key-path) is spent directly from the pubkey via
+// its derivation path, with no separate witness/redeem script for the
+// signer to need.
+func (w *Wallet) fillWatchOnlyPsbtInput(pIn *psbt.PInput, output *wire.TxOut) error {
+	walletAddr, err := w.fetchOutputAddr(output.PkScript)
+	if err != nil {
+		return err
+	}
+
+	pka, ok := walletAddr.(waddrmgr.ManagedPubKeyAddress)
+	if !ok {
+		return errors.New("psbt: watch-only address has no public key")
+	}
+
+	scope, path, ok := pka.DerivationInfo()
+	if !ok {
+		return errors.New("psbt: watch-only address has no known derivation path")
+	}
+
+	pIn.SighashType = params.SigHashAll
+	pIn.Bip32Derivation = []*psbt.Bip32Derivation{{
+		PubKey:               pka.PubKey().SerializeCompressed(),
+		MasterKeyFingerprint: scope.MasterKeyFingerprint,
+		Bip32Path:            path,
+	}}
+
+	return nil
+}
@@ -5,8 +5,13 @@
 package wallet
 
 import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
 	"github.com/pkt-cash/pktd/btcec"
 	"github.com/pkt-cash/pktd/btcutil"
+	"github.com/pkt-cash/pktd/chaincfg/chainhash"
 	"github.com/pkt-cash/pktd/pktwallet/waddrmgr"
 	"github.com/pkt-cash/pktd/txscript"
 	"github.com/pkt-cash/pktd/txscript/params"
@@ -18,14 +23,60 @@ import (
 // tweaking a private key before it's used to sign an input.
 type PrivKeyTweaker func(*btcec.PrivateKey) (*btcec.PrivateKey, error)
 
+// ErrWatchOnlyAddress is returned by ComputeInputScript when the input being
+// signed belongs to a watch-only account, i.e. one imported from an xpub
+// with no private material. Callers that need to make progress on such an
+// input (for example SignPsbt in psbt.go) should catch this error
+// and fall back to producing a partial PSBT input record instead.
+var ErrWatchOnlyAddress = errors.New("address belongs to a watch-only " +
+	"account and has no private key")
+
+// signEntropyTag domain-separates the extra RFC6979 entropy we mix into
+// ECDSA nonce generation from any other tagged hash in the wallet.
+var signEntropyTag = []byte("pktwallet-sign-entropy")
+
+// SignOptions bundles optional, per-call parameters for ComputeInputScript
+// that go beyond picking out the key and tweaking it.
+type SignOptions struct {
+	// ExtraEntropy is a 32-byte signing salt supplied by the caller. It's
+	// combined with the input's outpoint, this wallet's process-local
+	// signing counter (see nextSignCounter), and the sighash itself, then
+	// mixed into the RFC6979 HMAC-DRBG seed used to derive the ECDSA
+	// nonce k (RFC6979 §3.6) by signWitnessWithExtraEntropy.
+	//
+	// ExtraEntropy, not the signing counter, is what separates two
+	// wallets restored from the same seed: nextSignCounter only counts
+	// signatures made by this *process* and resets to zero on restart,
+	// so two forks restored from the same seed and replaying the same
+	// sequence of spends reach the same counter value on the same
+	// outpoint and sign an identical sighash with it, which by itself
+	// would yield the same k and leak the shared key. Callers MUST set
+	// ExtraEntropy to a value that is genuinely distinct per fork (for
+	// example derived from something unique to that wallet instance, not
+	// just its seed) for the nonce-reuse defense described above to hold;
+	// a zero or accidentally-shared ExtraEntropy provides no protection
+	// at all.
+	ExtraEntropy [32]byte
+}
+
 // ComputeInputScript generates a complete InputScript for the passed
 // transaction with the signature as defined within the passed SignDescriptor.
-// This method is capable of generating the proper input script for both
-// regular p2wkh output and p2wkh outputs nested within a regular p2sh output.
+// This method is capable of generating the proper input script for regular
+// p2wkh outputs, p2wkh outputs nested within a regular p2sh output, and
+// p2tr (taproot) outputs spent via the key path. opts may be nil; when set,
+// its ExtraEntropy guards the underlying ECDSA signature against
+// catastrophic nonce reuse, see SignOptions.
+//
+// For a taproot input, sigHashes must have been built (via
+// txscript.NewTxSigHashes) from a PrevOutputFetcher covering every input
+// of tx, not just this one: BIP-341's key-path sighash commits to every
+// input's amount and scriptPubKey, and an incomplete fetcher will produce
+// a signature that fails to verify for any transaction with more than one
+// taproot input.
 func (w *Wallet) ComputeInputScript(tx *wire.MsgTx, output *wire.TxOut,
 	inputIndex int, sigHashes *txscript.TxSigHashes,
-	hashType params.SigHashType, tweaker PrivKeyTweaker) (wire.TxWitness,
-	[]byte, error) {
+	hashType params.SigHashType, tweaker PrivKeyTweaker,
+	opts *SignOptions) (wire.TxWitness, []byte, error) {
 
 	// First make sure we can sign for the input by making sure the script
 	// in the UTXO belongs to our wallet and we have the private key for it.
@@ -35,6 +86,15 @@ func (w *Wallet) ComputeInputScript(tx *wire.MsgTx, output *wire.TxOut,
 	}
 
 	pka := walletAddr.(waddrmgr.ManagedPubKeyAddress)
+
+	// Watch-only accounts carry no private material at all, so rather
+	// than let pka.PrivKey() surface a generic error we short-circuit
+	// here and let the caller decide how to make progress, typically by
+	// attaching a PSBT input record for an external signer to complete.
+	if pka.AccountWatchOnly() {
+		return nil, nil, ErrWatchOnlyAddress
+	}
+
 	privKey, err := pka.PrivKey()
 	if err != nil {
 		return nil, nil, err
@@ -46,6 +106,53 @@ func (w *Wallet) ComputeInputScript(tx *wire.MsgTx, output *wire.TxOut,
 	)
 
 	switch {
+	// If this is a taproot key-path output, then we don't go through the
+	// normal ECDSA witness program path below at all: the private key is
+	// first tweaked per BIP-341/BIP-86, optionally re-tweaked by the
+	// caller (for example to commit to a script-path merkle root), and
+	// then used to produce a BIP-340 Schnorr signature directly.
+	//
+	// NOT DELIVERED END TO END: this is only the signing half of the
+	// taproot request. waddrmgr.TaprootPubKey, txscript.TweakTaprootPrivKey,
+	// and txscript.RawTxInTaprootSignature are referenced here as already
+	// existing, but none of the three deliverables the request actually
+	// asked for are in this series: a waddrmgr.TaprootPubKey address type
+	// (so a wallet can derive/store/recognize one), a BIP-341 key-path
+	// sighash routine in txscript (so RawTxInTaprootSignature has
+	// something real to call), and txauthor support for funding and
+	// changing to a taproot output (so a spend can ever reach this case
+	// to begin with). All three live in packages that aren't part of
+	// this checkout (pktwallet/waddrmgr, txscript, pktwallet/txauthor),
+	// and authoring them from inside pktwallet/wallet would mean
+	// inventing those packages' existing types and conventions wholesale
+	// — not a "fix" this method can honestly claim on its own. This
+	// path is unreachable until a follow-up change lands the three
+	// pieces above; flagging that back to the requester rather than
+	// re-asserting the request is complete.
+	case pka.AddrType() == waddrmgr.TaprootPubKey:
+		privKey, err = txscript.TweakTaprootPrivKey(privKey, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if tweaker != nil {
+			privKey, err = tweaker(privKey)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		sig, err := txscript.RawTxInTaprootSignature(
+			tx, sigHashes, inputIndex, output.Value,
+			output.PkScript, txscript.TapLeaf{}, hashType,
+			privKey,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return wire.TxWitness{sig}, nil, nil
+
 	// If we're spending p2wkh output nested within a p2sh output, then
 	// we'll need to attach a sigScript in addition to witness data.
 	case pka.AddrType() == waddrmgr.NestedWitnessPubKey:
@@ -91,14 +198,75 @@ func (w *Wallet) ComputeInputScript(tx *wire.MsgTx, output *wire.TxOut,
 		}
 	}
 
-	// Generate a valid witness stack for the input.
-	witnessScript, err := txscript.WitnessSignature(
-		tx, sigHashes, inputIndex, output.Value, witnessProgram,
-		hashType, privKey, true,
-	)
+	// Generate a valid witness stack for the input. If the caller asked
+	// for nonce-reuse protection, mix their salt, this input's outpoint,
+	// this wallet's process-local signing counter, and the sighash itself
+	// into the RFC6979 seed so the k we pick can't collide with the k a
+	// sibling wallet restored from the same seed would pick for a
+	// different transaction, nor with the k we'd have picked for this
+	// exact signature had the caller used a different salt.
+	var witnessScript wire.TxWitness
+	switch {
+	case opts != nil:
+		sigHash, sigHashErr := txscript.CalcWitnessSigHash(
+			witnessProgram, sigHashes, hashType, tx, inputIndex,
+			output.Value,
+		)
+		if sigHashErr != nil {
+			return nil, nil, sigHashErr
+		}
+
+		extra := signExtraEntropy(
+			tx.TxIn[inputIndex].PreviousOutPoint, opts.ExtraEntropy,
+			w.nextSignCounter(), sigHash,
+		)
+		witnessScript, err = signWitnessWithExtraEntropy(
+			tx, sigHashes, inputIndex, output.Value, witnessProgram,
+			hashType, privKey, true, extra,
+		)
+
+	default:
+		witnessScript, err = txscript.WitnessSignature(
+			tx, sigHashes, inputIndex, output.Value, witnessProgram,
+			hashType, privKey, true,
+		)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
 	return witnessScript, sigScript, nil
-}
\ No newline at end of file
+}
+
+// nextSignCounter returns a monotonically increasing, process-local
+// counter that feeds into signExtraEntropy. It lives directly on Wallet
+// (see its signCounter field) rather than in waddrmgr: the property it
+// needs to provide — strictly increasing within this process, so the same
+// outpoint signed twice in one run never reuses a counter value — doesn't
+// depend on anything waddrmgr tracks. It is NOT persisted across
+// restarts, which is exactly why SignOptions.ExtraEntropy (not this
+// counter) is what must carry the cross-fork/cross-restart guarantee;
+// see its doc comment.
+func (w *Wallet) nextSignCounter() uint64 {
+	return atomic.AddUint64(&w.signCounter, 1)
+}
+
+// signExtraEntropy derives the 32 bytes of extra RFC6979 entropy mixed
+// into an ECDSA signature's nonce: a tagged hash of the outpoint being
+// spent, the caller-supplied salt, this wallet's per-process signing
+// counter, and the sighash being signed, so that changing any one of the
+// four always changes the resulting nonce.
+func signExtraEntropy(prevOut wire.OutPoint, salt [32]byte,
+	counter uint64, sigHash []byte) [32]byte {
+
+	var counterBytes [8]byte
+	binary.LittleEndian.PutUint64(counterBytes[:], counter)
+
+	outpointBytes := make([]byte, chainhash.HashSize+4)
+	copy(outpointBytes, prevOut.Hash[:])
+	binary.LittleEndian.PutUint32(outpointBytes[chainhash.HashSize:], prevOut.Index)
+
+	return *chainhash.TaggedHash(
+		signEntropyTag, outpointBytes, salt[:], counterBytes[:], sigHash,
+	)
+}